@@ -0,0 +1,422 @@
+// Package basicstation implements a LoRa Gateway Bridge backend for gateways
+// that speak the Semtech Basic Station LNS protocol. Unlike the semtechudp
+// backend, which pushes JSON packet-forwarder configuration files over UDP,
+// this backend serves gateways over a WebSocket connection: gateways first
+// hit the /router-info discovery endpoint to learn the muxs URI, then open a
+// WebSocket to /router/<EUI> on which version / jreq / updf / dnmsg frames
+// are exchanged.
+package basicstation
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/loraserver/api/gw"
+	"github.com/brocaar/lorawan"
+
+	"github.com/brocaar/lora-gateway-bridge/pkg/config/sx1301"
+)
+
+// GetGatewayConfigFunc resolves the channel-plan configuration that must be
+// pushed to a gateway when it (re)connects and sends its version message.
+type GetGatewayConfigFunc func(gatewayID lorawan.EUI64) (gw.GatewayConfigPacket, error)
+
+// GetHardwareProfileFunc resolves the hardware profile (RSSI offset, TX
+// ranges, clock source, antenna gain, ...) of the given gateway.
+type GetHardwareProfileFunc func(gatewayID lorawan.EUI64) (sx1301.HardwareProfile, error)
+
+// Backend implements a Basic Station LNS backend.
+type Backend struct {
+	sync.RWMutex
+
+	ln                     *http.Server
+	tlsConfig              *tls.Config
+	muxURI                 string
+	region                 string
+	netID                  lorawan.NetID
+	upgrader               websocket.Upgrader
+	getGatewayConfigFunc   GetGatewayConfigFunc
+	getHardwareProfileFunc GetHardwareProfileFunc
+	gateways               map[lorawan.EUI64]*gatewayConn
+
+	// wg tracks the per-connection goroutines spawned by handleRouter, and
+	// done is closed by Stop so that any of them currently blocked sending
+	// on the channels below is released instead of deadlocking or racing
+	// the channel close.
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	rxPacketChan      chan gw.RXPacket
+	statsPacketChan   chan gw.GatewayStatsPacket
+	downlinkTXAckChan chan gw.DownlinkTXAck
+}
+
+// gatewayConn holds the state of a single connected gateway.
+type gatewayConn struct {
+	sync.Mutex
+	conn *websocket.Conn
+
+	// lastXTime and lastRCtx are taken from the most recent uplink so that
+	// downlinks can be scheduled relative to the gateway's internal
+	// concentrator clock.
+	lastXTime int64
+	lastRCtx  int64
+}
+
+// NewBackend creates a new Basic Station backend. bind is the "ip:port" the
+// HTTP(S) server will listen on, muxURI is the ws(s):// URI that is handed
+// out by the /router-info endpoint, region is the LoRaWAN region name and
+// netID is the network identifier advertised in router_config messages,
+// getGatewayConfigFunc resolves the channel-plan to push to a gateway when
+// it connects, and getHardwareProfileFunc resolves its board-specific
+// hardware profile.
+func NewBackend(bind, muxURI, region string, netID lorawan.NetID, tlsConfig *tls.Config, getGatewayConfigFunc GetGatewayConfigFunc, getHardwareProfileFunc GetHardwareProfileFunc) (*Backend, error) {
+	b := Backend{
+		tlsConfig:              tlsConfig,
+		muxURI:                 muxURI,
+		region:                 region,
+		netID:                  netID,
+		getGatewayConfigFunc:   getGatewayConfigFunc,
+		getHardwareProfileFunc: getHardwareProfileFunc,
+		gateways:               make(map[lorawan.EUI64]*gatewayConn),
+		done:                   make(chan struct{}),
+
+		rxPacketChan:      make(chan gw.RXPacket),
+		statsPacketChan:   make(chan gw.GatewayStatsPacket),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/router-info", b.handleRouterInfo).Methods("POST")
+	router.HandleFunc("/router/{eui}", b.handleRouter)
+
+	b.ln = &http.Server{
+		Addr:      bind,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	go func() {
+		var err error
+		if b.tlsConfig != nil {
+			err = b.ln.ListenAndServeTLS("", "")
+		} else {
+			err = b.ln.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal("basicstation: listener error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the backend. It stops accepting new connections, closes every
+// currently connected gateway so its handleRouter goroutine returns, and
+// waits for all of them to finish (so none can still be sending on the
+// channels below) before closing those channels.
+func (b *Backend) Stop() error {
+	close(b.done)
+
+	err := b.ln.Close()
+
+	b.RLock()
+	for _, gwConn := range b.gateways {
+		gwConn.conn.Close()
+	}
+	b.RUnlock()
+
+	b.wg.Wait()
+
+	close(b.rxPacketChan)
+	close(b.statsPacketChan)
+	close(b.downlinkTXAckChan)
+
+	return err
+}
+
+// RXPacketChan returns the channel on which uplink frames are emitted.
+func (b *Backend) RXPacketChan() chan gw.RXPacket {
+	return b.rxPacketChan
+}
+
+// StatsPacketChan returns the channel on which gateway stats are emitted.
+func (b *Backend) StatsPacketChan() chan gw.GatewayStatsPacket {
+	return b.statsPacketChan
+}
+
+// DownlinkTXAckChan returns the channel on which downlink tx acks are
+// emitted.
+func (b *Backend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+// handleRouterInfo implements the /router-info discovery endpoint. It
+// responds with the muxs URI that the gateway must connect to.
+func (b *Backend) handleRouterInfo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Router string `json:"router"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithError(err).Error("basicstation: decode router-info request error")
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	resp := struct {
+		Router string `json:"router"`
+		Muxs   string `json:"muxs"`
+	}{
+		Router: req.Router,
+		Muxs:   b.muxURI,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.WithError(err).Error("basicstation: encode router-info response error")
+	}
+}
+
+// handleRouter upgrades the connection to a WebSocket and handles the
+// version / jreq / updf / dnmsg message exchange for a single gateway.
+func (b *Backend) handleRouter(w http.ResponseWriter, r *http.Request) {
+	euiStr := strings.Trim(mux.Vars(r)["eui"], ":")
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(euiStr)); err != nil {
+		log.WithError(err).WithField("eui", euiStr).Error("basicstation: parse gateway id error")
+		http.Error(w, "bad gateway id", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Error("basicstation: websocket upgrade error")
+		return
+	}
+
+	gwConn := &gatewayConn{conn: conn}
+
+	// Register under the lock and only while Stop has not begun, so that
+	// Stop either sees (and waits for) this connection or this handler
+	// returns here without ever sending on the channels.
+	b.Lock()
+	select {
+	case <-b.done:
+		b.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	b.wg.Add(1)
+	b.gateways[gatewayID] = gwConn
+	b.Unlock()
+	defer b.wg.Done()
+
+	log.WithField("gateway_id", gatewayID).Info("basicstation: gateway connected")
+
+	defer func() {
+		b.Lock()
+		delete(b.gateways, gatewayID)
+		b.Unlock()
+		conn.Close()
+		log.WithField("gateway_id", gatewayID).Info("basicstation: gateway disconnected")
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if err := b.handleMessage(gatewayID, gwConn, data); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("basicstation: handle message error")
+		}
+	}
+}
+
+// handleMessage dispatches an incoming frame based on its msgtype.
+func (b *Backend) handleMessage(gatewayID lorawan.EUI64, gwConn *gatewayConn, data []byte) error {
+	var mt messageType
+	if err := json.Unmarshal(data, &mt); err != nil {
+		return errors.Wrap(err, "unmarshal msgtype error")
+	}
+
+	switch mt.MsgType {
+	case msgTypeVersion:
+		return b.handleVersion(gatewayID, gwConn, data)
+	case msgTypeJoinRequest:
+		return b.handleJoinRequest(gatewayID, gwConn, data)
+	case msgTypeUplinkDataFrame:
+		return b.handleUplinkDataFrame(gatewayID, gwConn, data)
+	case msgTypeDownlinkTxed:
+		return b.handleDownlinkTxed(gatewayID, data)
+	default:
+		return fmt.Errorf("unknown msgtype: %s", mt.MsgType)
+	}
+}
+
+// handleVersion responds to the gateway's version message with the
+// router_config the gateway must apply.
+func (b *Backend) handleVersion(gatewayID lorawan.EUI64, gwConn *gatewayConn, data []byte) error {
+	var version versionMessage
+	if err := json.Unmarshal(data, &version); err != nil {
+		return errors.Wrap(err, "unmarshal version message error")
+	}
+
+	if b.getGatewayConfigFunc == nil {
+		return errors.New("no GetGatewayConfigFunc configured")
+	}
+
+	conf, err := b.getGatewayConfigFunc(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway configuration error")
+	}
+
+	var hwProfile sx1301.HardwareProfile
+	if b.getHardwareProfileFunc != nil {
+		hwProfile, err = b.getHardwareProfileFunc(gatewayID)
+		if err != nil {
+			return errors.Wrap(err, "get hardware profile error")
+		}
+	}
+
+	rc, err := buildRouterConfig(b.region, b.netID, conf, hwProfile)
+	if err != nil {
+		return errors.Wrap(err, "build router_config error")
+	}
+
+	gwConn.Lock()
+	defer gwConn.Unlock()
+	return gwConn.conn.WriteJSON(rc)
+}
+
+// handleJoinRequest handles an incoming join-request (jreq) frame.
+func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, gwConn *gatewayConn, data []byte) error {
+	var jreq joinRequestMessage
+	if err := json.Unmarshal(data, &jreq); err != nil {
+		return errors.Wrap(err, "unmarshal jreq message error")
+	}
+
+	gwConn.Lock()
+	gwConn.lastXTime = jreq.UpInfo.XTime
+	gwConn.lastRCtx = jreq.UpInfo.RCtx
+	gwConn.Unlock()
+
+	phy, err := decodeJoinRequest(jreq)
+	if err != nil {
+		return errors.Wrap(err, "decode join-request error")
+	}
+
+	select {
+	case b.rxPacketChan <- gw.RXPacket{RXInfo: rxInfoFromUpInfo(gatewayID, jreq.Freq, jreq.UpInfo), PHYPayload: phy}:
+	case <-b.done:
+	}
+
+	log.WithField("gateway_id", gatewayID).Debug("basicstation: received join-request")
+
+	return nil
+}
+
+// handleUplinkDataFrame handles an incoming uplink data frame (updf).
+func (b *Backend) handleUplinkDataFrame(gatewayID lorawan.EUI64, gwConn *gatewayConn, data []byte) error {
+	var updf uplinkDataFrameMessage
+	if err := json.Unmarshal(data, &updf); err != nil {
+		return errors.Wrap(err, "unmarshal updf message error")
+	}
+
+	gwConn.Lock()
+	gwConn.lastXTime = updf.UpInfo.XTime
+	gwConn.lastRCtx = updf.UpInfo.RCtx
+	gwConn.Unlock()
+
+	phy, err := decodeUplinkDataFrame(updf)
+	if err != nil {
+		return errors.Wrap(err, "decode uplink data frame error")
+	}
+
+	select {
+	case b.rxPacketChan <- gw.RXPacket{RXInfo: rxInfoFromUpInfo(gatewayID, updf.Freq, updf.UpInfo), PHYPayload: phy}:
+	case <-b.done:
+	}
+
+	log.WithField("gateway_id", gatewayID).Debug("basicstation: received uplink data frame")
+
+	return nil
+}
+
+// handleDownlinkTxed handles the gateway's confirmation (dntxed) that a
+// previously scheduled downlink was transmitted.
+func (b *Backend) handleDownlinkTxed(gatewayID lorawan.EUI64, data []byte) error {
+	var dntxed downlinkTxedMessage
+	if err := json.Unmarshal(data, &dntxed); err != nil {
+		return errors.Wrap(err, "unmarshal dntxed message error")
+	}
+
+	ack := gw.DownlinkTXAck{
+		GatewayID: gatewayID,
+		Token:     uint16(dntxed.DIID),
+		Error:     dntxed.Error,
+	}
+
+	select {
+	case b.downlinkTXAckChan <- ack:
+	case <-b.done:
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"diid":       dntxed.DIID,
+	}).Debug("basicstation: downlink transmitted")
+
+	return nil
+}
+
+// SendDownlinkFrame schedules a downlink on the given gateway, with both the
+// RX1 and RX2 receive window parameters so that the gateway can fall back to
+// RX2 if RX1 is missed, plus the priority it should transmit it at. The
+// xtime and rctx bookkeeping needed for the gateway to convert the requested
+// tx time into its own concentrator clock are taken from the most recent
+// uplink received from that gateway, so that Class A replies round-trip
+// correctly.
+func (b *Backend) SendDownlinkFrame(gatewayID lorawan.EUI64, diid int64, devEUI lorawan.EUI64, rxDelay, rx1DR, rx1Freq, rx2DR, rx2Freq, priority int, pdu string) error {
+	b.RLock()
+	gwConn, ok := b.gateways[gatewayID]
+	b.RUnlock()
+	if !ok {
+		return fmt.Errorf("gateway %s is not connected", gatewayID)
+	}
+
+	gwConn.Lock()
+	defer gwConn.Unlock()
+
+	dn := downlinkMessage{
+		MsgType:  msgTypeDownlinkMessage,
+		DevEui:   devEUI.String(),
+		DIID:     diid,
+		PDU:      pdu,
+		RxDelay:  rxDelay,
+		RX1DR:    rx1DR,
+		RX1Freq:  rx1Freq,
+		RX2DR:    rx2DR,
+		RX2Freq:  rx2Freq,
+		Priority: priority,
+		XTime:    gwConn.lastXTime,
+		RCtx:     gwConn.lastRCtx,
+	}
+
+	return gwConn.conn.WriteJSON(dn)
+}
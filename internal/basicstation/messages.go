@@ -0,0 +1,119 @@
+package basicstation
+
+// Basic Station message types, as sent over the LNS WebSocket connection.
+// See: https://doc.sm.tc/station/tcproto.html
+const (
+	msgTypeVersion         = "version"
+	msgTypeRouterConfig    = "router_config"
+	msgTypeJoinRequest     = "jreq"
+	msgTypeUplinkDataFrame = "updf"
+	msgTypeDownlinkMessage = "dnmsg"
+	msgTypeDownlinkTxed    = "dntxed"
+)
+
+// messageType is used to sniff the msgtype field of an incoming frame before
+// unmarshaling it into its concrete type.
+type messageType struct {
+	MsgType string `json:"msgtype"`
+}
+
+// versionMessage is sent by the gateway right after connecting, identifying
+// its hardware and firmware so that the LNS can return a matching
+// router_config.
+type versionMessage struct {
+	Station  string `json:"station"`
+	Firmware string `json:"firmware"`
+	Package  string `json:"package"`
+	Model    string `json:"model"`
+	Protocol int    `json:"protocol"`
+	Features string `json:"features"`
+}
+
+// routerConfigMessage is the reply to a version message. It describes the
+// channel-plan and radio configuration the gateway must apply.
+type routerConfigMessage struct {
+	MsgType    string                   `json:"msgtype"`
+	NetID      []int                    `json:"NetID"`
+	JoinEui    [][2]uint64              `json:"JoinEui"`
+	Region     string                   `json:"region"`
+	HWSpec     string                   `json:"hwspec"`
+	FreqRange  [2]int                   `json:"freq_range"`
+	DRs        [][3]int                 `json:"DRs"`
+	SX1301Conf []map[string]interface{} `json:"sx1301_conf"`
+	NoCCA      bool                     `json:"nocca"`
+	NoDC       bool                     `json:"nodc"`
+	NoDwell    bool                     `json:"nodwell"`
+}
+
+// upInfo carries the radio metadata of a received frame.
+type upInfo struct {
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float64 `json:"rssi"`
+	SNR     float64 `json:"snr"`
+}
+
+// joinRequestMessage (jreq) carries a LoRaWAN join-request uplink.
+type joinRequestMessage struct {
+	MsgType  string  `json:"msgtype"`
+	MHdr     int     `json:"MHdr"`
+	JoinEui  string  `json:"JoinEui"`
+	DevEui   string  `json:"DevEui"`
+	DevNonce int     `json:"DevNonce"`
+	MIC      int32   `json:"MIC"`
+	DR       int     `json:"DR"`
+	Freq     int     `json:"Freq"`
+	RefTime  float64 `json:"RefTime"`
+	UpInfo   upInfo  `json:"upinfo"`
+}
+
+// uplinkDataFrameMessage (updf) carries a LoRaWAN data uplink.
+type uplinkDataFrameMessage struct {
+	MsgType    string  `json:"msgtype"`
+	MHdr       int     `json:"MHdr"`
+	DevAddr    int32   `json:"DevAddr"`
+	FCtrl      int     `json:"FCtrl"`
+	FCnt       int     `json:"FCnt"`
+	FOpts      string  `json:"FOpts"`
+	FPort      int     `json:"FPort"`
+	FRMPayload string  `json:"FRMPayload"`
+	MIC        int32   `json:"MIC"`
+	DR         int     `json:"DR"`
+	Freq       int     `json:"Freq"`
+	RefTime    float64 `json:"RefTime"`
+	UpInfo     upInfo  `json:"upinfo"`
+}
+
+// downlinkMessage (dnmsg) schedules a Class-A (or Class-C) downlink on the
+// gateway. XTime and RCtx are copied from the most recent uplink received
+// from the gateway so that it can compute the transmit time relative to its
+// own clock.
+type downlinkMessage struct {
+	MsgType  string `json:"msgtype"`
+	DevEui   string `json:"DevEui"`
+	DC       int    `json:"dC"`
+	DIID     int64  `json:"diid"`
+	PDU      string `json:"pdu"`
+	RxDelay  int    `json:"RxDelay"`
+	RX1DR    int    `json:"RX1DR"`
+	RX1Freq  int    `json:"RX1Freq"`
+	RX2DR    int    `json:"RX2DR"`
+	RX2Freq  int    `json:"RX2Freq"`
+	Priority int    `json:"priority"`
+	XTime    int64  `json:"xtime"`
+	RCtx     int64  `json:"rctx"`
+}
+
+// downlinkTxedMessage (dntxed) is the gateway's confirmation that a
+// previously scheduled downlink was transmitted. Error is non-empty when
+// the gateway failed to transmit it (e.g. it was dropped for colliding with
+// another scheduled transmission).
+type downlinkTxedMessage struct {
+	MsgType string `json:"msgtype"`
+	DIID    int64  `json:"diid"`
+	DevEui  string `json:"DevEui"`
+	RCtx    int64  `json:"rctx"`
+	XTime   int64  `json:"xtime"`
+	Error   string `json:"error"`
+}
@@ -0,0 +1,123 @@
+package basicstation
+
+import (
+	"fmt"
+
+	"github.com/brocaar/loraserver/api/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+
+	"github.com/brocaar/lora-gateway-bridge/pkg/config/sx1301"
+)
+
+// defaultJoinEUIRange is advertised when the backend is not configured to
+// restrict which JoinEUIs a gateway should forward join-requests for, i.e.
+// it accepts the full 64 bit range.
+var defaultJoinEUIRange = [2]uint64{0, 0xFFFFFFFFFFFFFFFF}
+
+// buildRouterConfig turns a GatewayConfigPacket into the router_config
+// message that is sent to the gateway in reply to its version message. The
+// channel-to-radio assignment is delegated to sx1301.GetConfig so that the
+// Basic Station and packet-forwarder backends stay in sync.
+func buildRouterConfig(region string, netID lorawan.NetID, conf gw.GatewayConfigPacket, hwProfile sx1301.HardwareProfile) (routerConfigMessage, error) {
+	c, err := sx1301.GetConfig(conf, hwProfile)
+	if err != nil {
+		return routerConfigMessage{}, err
+	}
+
+	freqMin, freqMax := freqRange(conf.Channels)
+	noCCA, noDC, noDwell := regionDutyCycleFlags(region)
+
+	out := routerConfigMessage{
+		MsgType:    msgTypeRouterConfig,
+		NetID:      []int{netIDToInt(netID)},
+		JoinEui:    [][2]uint64{defaultJoinEUIRange},
+		Region:     region,
+		HWSpec:     fmt.Sprintf("sx1301/%d", len(c.Concentrators)),
+		FreqRange:  [2]int{freqMin, freqMax},
+		DRs:        dataRates(conf.Channels),
+		SX1301Conf: c.SX1301Confs(),
+		NoCCA:      noCCA,
+		NoDC:       noDC,
+		NoDwell:    noDwell,
+	}
+
+	return out, nil
+}
+
+// netIDToInt packs a 3 byte lorawan.NetID into the plain integer the
+// router_config NetID field expects.
+func netIDToInt(netID lorawan.NetID) int {
+	return int(netID[0])<<16 | int(netID[1])<<8 | int(netID[2])
+}
+
+// freqRange returns the [min, max] frequency (in Hz) spanned by the given
+// channels, i.e. the range the gateway's radios must be able to tune across.
+func freqRange(channels []gw.Channel) (int, int) {
+	if len(channels) == 0 {
+		return 0, 0
+	}
+
+	min := channels[0].Frequency
+	max := channels[0].Frequency
+	for _, ch := range channels[1:] {
+		if ch.Frequency < min {
+			min = ch.Frequency
+		}
+		if ch.Frequency > max {
+			max = ch.Frequency
+		}
+	}
+
+	return min, max
+}
+
+// dataRates builds the DRs table the router_config message advertises: one
+// [spreading-factor, bandwidth (kHz), downlink-only] entry per LoRa
+// spreading-factor in use, and a single [0, 0, 0] entry when an FSK channel
+// is present.
+func dataRates(channels []gw.Channel) [][3]int {
+	var drs [][3]int
+	seen := make(map[[3]int]bool)
+	fsk := false
+
+	for _, ch := range channels {
+		switch ch.Modulation {
+		case band.LoRaModulation:
+			for _, sf := range ch.SpreadingFactors {
+				dr := [3]int{sf, ch.Bandwidth, 0}
+				if !seen[dr] {
+					seen[dr] = true
+					drs = append(drs, dr)
+				}
+			}
+		case band.FSKModulation:
+			fsk = true
+		}
+	}
+
+	if fsk {
+		drs = append(drs, [3]int{0, 0, 0})
+	}
+
+	return drs
+}
+
+// regionDutyCycleFlags returns the nocca/nodc/nodwell flags the gateway must
+// enforce for the given region. EU868 requires a duty-cycle limit, the
+// 915/923MHz regions require a dwell-time limit; no currently supported
+// region requires CCA (listen-before-talk).
+func regionDutyCycleFlags(region string) (noCCA, noDC, noDwell bool) {
+	noCCA = true
+	noDC = true
+	noDwell = true
+
+	switch region {
+	case "EU868":
+		noDC = false
+	case "US915", "AU915", "AS923":
+		noDwell = false
+	}
+
+	return noCCA, noDC, noDwell
+}
@@ -0,0 +1,123 @@
+package basicstation
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/loraserver/api/gw"
+	"github.com/brocaar/lorawan"
+)
+
+// parseEUI parses the hyphen-separated hex EUI format used by the Basic
+// Station protocol (e.g. "58-a0-cb-ff-fe-80-a1-7c") into a lorawan.EUI64.
+func parseEUI(s string) (lorawan.EUI64, error) {
+	var eui lorawan.EUI64
+	if err := eui.UnmarshalText([]byte(strings.Replace(s, "-", "", -1))); err != nil {
+		return eui, err
+	}
+	return eui, nil
+}
+
+// reverse returns a reversed copy of b. LoRaWAN encodes multi-byte fields
+// (EUIs, DevAddr, counters, ...) little-endian on the wire, while the values
+// handed to us by the jreq / updf messages (or parsed into lorawan.EUI64) are
+// in big-endian / network order.
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		out[len(b)-1-i] = v
+	}
+	return out
+}
+
+// decodeJoinRequest reconstructs the raw LoRaWAN PHYPayload of a join-request
+// (jreq) frame from its Basic Station JSON fields, so that it can be handed
+// to lorawan.PHYPayload.UnmarshalBinary like any other backend's uplink.
+func decodeJoinRequest(jreq joinRequestMessage) (lorawan.PHYPayload, error) {
+	var phy lorawan.PHYPayload
+
+	joinEUI, err := parseEUI(jreq.JoinEui)
+	if err != nil {
+		return phy, errors.Wrap(err, "parse joineui error")
+	}
+	devEUI, err := parseEUI(jreq.DevEui)
+	if err != nil {
+		return phy, errors.Wrap(err, "parse deveui error")
+	}
+
+	b := make([]byte, 0, 23)
+	b = append(b, byte(jreq.MHdr))
+	b = append(b, reverse(joinEUI[:])...)
+	b = append(b, reverse(devEUI[:])...)
+	b = append(b, byte(jreq.DevNonce), byte(jreq.DevNonce>>8))
+
+	var mic [4]byte
+	binary.LittleEndian.PutUint32(mic[:], uint32(jreq.MIC))
+	b = append(b, mic[:]...)
+
+	if err := phy.UnmarshalBinary(b); err != nil {
+		return phy, errors.Wrap(err, "unmarshal phypayload error")
+	}
+	return phy, nil
+}
+
+// decodeUplinkDataFrame reconstructs the raw LoRaWAN PHYPayload of a data
+// uplink (updf) frame from its Basic Station JSON fields. FRMPayload is kept
+// encrypted (it is handed upstream as-is); this backend has no access to the
+// device's session keys, same as the semtechudp backend's raw PHYPayload.
+func decodeUplinkDataFrame(updf uplinkDataFrameMessage) (lorawan.PHYPayload, error) {
+	var phy lorawan.PHYPayload
+
+	fOpts, err := hex.DecodeString(updf.FOpts)
+	if err != nil {
+		return phy, errors.Wrap(err, "decode fopts error")
+	}
+
+	frmPayload, err := hex.DecodeString(updf.FRMPayload)
+	if err != nil {
+		return phy, errors.Wrap(err, "decode frmpayload error")
+	}
+
+	b := make([]byte, 0, 12+len(fOpts)+len(frmPayload))
+	b = append(b, byte(updf.MHdr))
+
+	var devAddr [4]byte
+	binary.LittleEndian.PutUint32(devAddr[:], uint32(updf.DevAddr))
+	b = append(b, devAddr[:]...)
+
+	b = append(b, byte(updf.FCtrl))
+	b = append(b, byte(updf.FCnt), byte(updf.FCnt>>8))
+	b = append(b, fOpts...)
+
+	if len(frmPayload) > 0 {
+		b = append(b, byte(updf.FPort))
+		b = append(b, frmPayload...)
+	}
+
+	var mic [4]byte
+	binary.LittleEndian.PutUint32(mic[:], uint32(updf.MIC))
+	b = append(b, mic[:]...)
+
+	if err := phy.UnmarshalBinary(b); err != nil {
+		return phy, errors.Wrap(err, "unmarshal phypayload error")
+	}
+	return phy, nil
+}
+
+// rxInfoFromUpInfo translates the radio metadata of a jreq / updf frame into
+// the gw.RXInfo the rest of the bridge expects. DataRate is intentionally
+// left at its zero value: resolving the DR index into a band.DataRate needs
+// the same per-region channel-plan state as sx1301.GetConfig, which is not
+// threaded through to the per-connection uplink path yet.
+func rxInfoFromUpInfo(gatewayID lorawan.EUI64, freq int, info upInfo) gw.RXInfo {
+	return gw.RXInfo{
+		MAC:       gatewayID,
+		Frequency: freq,
+		CodeRate:  "4/5",
+		RSSI:      int(info.RSSI),
+		LoRaSNR:   info.SNR,
+	}
+}
@@ -0,0 +1,80 @@
+package sx1301
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// TXLUTConfig contains a single entry of a per-radio TX gain/power
+// calibration lookup table.
+type TXLUTConfig struct {
+	PAGain  int `toml:"pa_gain" json:"pa_gain"`
+	MixGain int `toml:"mix_gain" json:"mix_gain"`
+	RFPower int `toml:"rf_power" json:"rf_power"`
+	DigGain int `toml:"dig_gain" json:"dig_gain"`
+}
+
+// RadioProfile contains the hardware-specific values for a single radio
+// front-end that a packet-forwarder / Basic Station template does not
+// carry by itself, because they depend on the board the concentrator chip
+// was calibrated for rather than on the channel-plan.
+type RadioProfile struct {
+	RSSIOffset   float64       `toml:"rssi_offset"`
+	TXEnable     bool          `toml:"tx_enable"`
+	TXFreqMin    int           `toml:"tx_freq_min"`
+	TXFreqMax    int           `toml:"tx_freq_max"`
+	TXNotchFreq  int           `toml:"tx_notch_freq"`
+	TXLUTConfigs []TXLUTConfig `toml:"tx_lut_configs"`
+}
+
+// ConcentratorHardwareProfile contains the hardware-specific, board-level
+// values for a single concentrator chip, plus the profile for each of its
+// radios.
+type ConcentratorHardwareProfile struct {
+	ClockSource   int            `toml:"clock_source"`
+	AntennaGain   float64        `toml:"antenna_gain"`
+	LoRaWANPublic bool           `toml:"lorawan_public"`
+	Radios        []RadioProfile `toml:"radios"`
+}
+
+// HardwareProfile contains the hardware-specific values of a gateway,
+// loaded from a file maintained separately from the packet-forwarder /
+// Basic Station configuration template. This lets operators reuse the same
+// template across boards with different RSSI offsets, TX ranges, clock
+// sources and antenna gains, instead of having to bake those values into
+// every template.
+type HardwareProfile struct {
+	Concentrators []ConcentratorHardwareProfile `toml:"concentrators"`
+}
+
+// LoadHardwareProfile loads a HardwareProfile from the given TOML file.
+func LoadHardwareProfile(filePath string) (HardwareProfile, error) {
+	var hp HardwareProfile
+	if _, err := toml.DecodeFile(filePath, &hp); err != nil {
+		return hp, errors.Wrap(err, "decode hardware profile file error")
+	}
+	return hp, nil
+}
+
+// radioProfile returns the hardware profile for the given concentrator /
+// radio index, or a zero value when the profile does not cover it.
+func (hp HardwareProfile) radioProfile(concentrator, radio int) RadioProfile {
+	if concentrator >= len(hp.Concentrators) {
+		return RadioProfile{}
+	}
+	c := hp.Concentrators[concentrator]
+	if radio >= len(c.Radios) {
+		return RadioProfile{}
+	}
+	return c.Radios[radio]
+}
+
+// concentratorProfile returns the board-level hardware profile for the
+// given concentrator index, or a zero value when the profile does not
+// cover it.
+func (hp HardwareProfile) concentratorProfile(concentrator int) ConcentratorHardwareProfile {
+	if concentrator >= len(hp.Concentrators) {
+		return ConcentratorHardwareProfile{}
+	}
+	return hp.Concentrators[concentrator]
+}
@@ -0,0 +1,406 @@
+// Package sx1301 implements the channel-to-radio placement logic shared by
+// the packet-forwarder and Basic Station backends. Given a gateway's
+// requested channel-plan and its hardware profile, GetConfig resolves a
+// fully validated Config describing how the channels are laid out across
+// one or more SX1301 concentrator chips.
+package sx1301
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brocaar/loraserver/api/gw"
+	"github.com/brocaar/lorawan/band"
+)
+
+// radioBandwidthPerChannelBandwidth defines the bandwidth that a single
+// radio can cover per channel bandwidth.
+var radioBandwidthPerChannelBandwidth = map[int]int{
+	500000: 1100000, // 500kHz channel
+	250000: 1000000, // 250kHz channel
+	125000: 925000,  // 125kHz channel
+}
+
+// defaultRadioBandwidth defines the radio bandwidth in case the channel
+// bandwidth does not match any of the above values.
+const defaultRadioBandwidth = 925000
+
+// maxRadiosPerConcentrator defines the number of radio front-ends a single
+// SX1301 concentrator chip exposes.
+const maxRadiosPerConcentrator = 2
+
+// maxMultiSFChannelsPerConcentrator defines the number of multi-SF channels
+// a single SX1301 concentrator chip can demodulate concurrently.
+const maxMultiSFChannelsPerConcentrator = 8
+
+// minFSKDataRate and maxFSKDataRate define the FSK datarate range the
+// SX1301 chip supports.
+const (
+	minFSKDataRate = 500
+	maxFSKDataRate = 300000
+)
+
+// ChannelError is returned when a single channel of the requested
+// configuration could not be placed or fails validation. Channel is the
+// index into the GatewayConfigPacket.Channels slice that caused the error,
+// or -1 when the error concerns a concentrator as a whole (see
+// Config.Validate).
+type ChannelError struct {
+	Channel int
+	Reason  string
+}
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("sx1301: channel %d: %s", e.Channel, e.Reason)
+}
+
+// RadioConfig contains the radio configuration.
+type RadioConfig struct {
+	Enable bool
+	Freq   int
+
+	// The fields below are populated from the gateway's HardwareProfile
+	// rather than derived from the channel-plan.
+	RSSIOffset   float64
+	TXEnable     bool
+	TXFreqMin    int
+	TXFreqMax    int
+	TXNotchFreq  int
+	TXLUTConfigs []TXLUTConfig
+}
+
+// MultiSFChannelConfig contains the configuration for a multi spreading-factor
+// channel.
+type MultiSFChannelConfig struct {
+	Enable bool
+	Radio  int
+	IF     int
+	Freq   int
+}
+
+// LoRaSTDChannelConfig contains the configuration for a single
+// spreading-factor LoRa channel.
+type LoRaSTDChannelConfig struct {
+	Enable       bool
+	Radio        int
+	IF           int
+	Bandwidth    int
+	SpreadFactor int
+	Freq         int
+}
+
+// FSKChannelConfig contains the configuratio for a FSK channel.
+type FSKChannelConfig struct {
+	Enable    bool
+	Radio     int
+	IF        int
+	Bandwidth int
+	DataRate  int
+	Freq      int
+}
+
+// ConcentratorConfig contains the radio and channel configuration for a
+// single SX1301 concentrator chip. A gateway with multiple concentrator
+// chips (e.g. to cover more channels than a single chip supports) is
+// represented as multiple ConcentratorConfig values.
+type ConcentratorConfig struct {
+	Radios               []RadioConfig
+	MultiSFChannels      []MultiSFChannelConfig
+	LoRaSTDChannelConfig LoRaSTDChannelConfig
+	FSKChannelConfig     FSKChannelConfig
+
+	// The fields below are populated from the gateway's HardwareProfile
+	// rather than derived from the channel-plan.
+	ClockSource   int
+	AntennaGain   float64
+	LoRaWANPublic bool
+}
+
+// SX1301Conf returns the SX1301_conf object as used by the packet-forwarder
+// and Basic Station configurations. The keys of the returned map (radio_0,
+// chan_multiSF_0, chan_Lora_std, chan_FSK, ...) match the leaves that both
+// config formats expect.
+func (cc ConcentratorConfig) SX1301Conf() map[string]interface{} {
+	out := make(map[string]interface{})
+
+	for i, r := range cc.Radios {
+		out[fmt.Sprintf("radio_%d", i)] = map[string]interface{}{
+			"enable":         r.Enable,
+			"freq":           r.Freq,
+			"rssi_offset":    r.RSSIOffset,
+			"tx_enable":      r.TXEnable,
+			"tx_freq_min":    r.TXFreqMin,
+			"tx_freq_max":    r.TXFreqMax,
+			"tx_notch_freq":  r.TXNotchFreq,
+			"tx_lut_configs": r.TXLUTConfigs,
+		}
+	}
+
+	for i, c := range cc.MultiSFChannels {
+		out[fmt.Sprintf("chan_multiSF_%d", i)] = map[string]interface{}{
+			"enable": c.Enable,
+			"radio":  c.Radio,
+			"if":     c.IF,
+		}
+	}
+
+	out["chan_Lora_std"] = map[string]interface{}{
+		"enable":        cc.LoRaSTDChannelConfig.Enable,
+		"radio":         cc.LoRaSTDChannelConfig.Radio,
+		"if":            cc.LoRaSTDChannelConfig.IF,
+		"bandwidth":     cc.LoRaSTDChannelConfig.Bandwidth,
+		"spread_factor": cc.LoRaSTDChannelConfig.SpreadFactor,
+	}
+
+	out["chan_FSK"] = map[string]interface{}{
+		"enable":    cc.FSKChannelConfig.Enable,
+		"radio":     cc.FSKChannelConfig.Radio,
+		"if":        cc.FSKChannelConfig.IF,
+		"bandwidth": cc.FSKChannelConfig.Bandwidth,
+		"datarate":  cc.FSKChannelConfig.DataRate,
+	}
+
+	out["lorawan_public"] = cc.LoRaWANPublic
+	out["clksrc"] = cc.ClockSource
+	out["antenna_gain"] = cc.AntennaGain
+
+	return out
+}
+
+// Config contains the radio configuration for a gateway, split out per
+// concentrator chip.
+type Config struct {
+	Concentrators []ConcentratorConfig
+}
+
+// SX1301Confs returns the SX1301_conf object for every concentrator, in
+// concentrator order. This is the shape the Basic Station router_config
+// message embeds its sx1301_conf array with.
+func (c Config) SX1301Confs() []map[string]interface{} {
+	out := make([]map[string]interface{}, len(c.Concentrators))
+	for i, cc := range c.Concentrators {
+		out[i] = cc.SX1301Conf()
+	}
+	return out
+}
+
+// PacketForwarderJSON returns the legacy packet-forwarder shape, where every
+// concentrator's SX1301_conf block is a sibling top-level key
+// (SX1301_conf, SX1301_conf_1, SX1301_conf_2, ...) rather than array
+// elements.
+func (c Config) PacketForwarderJSON() map[string]interface{} {
+	out := make(map[string]interface{})
+	for i, cc := range c.Concentrators {
+		out[ConfKey(i)] = cc.SX1301Conf()
+	}
+	return out
+}
+
+// ConfKey returns the JSON key under which the i:th concentrator's
+// SX1301_conf block is stored, matching the naming convention used by
+// multi-concentrator packet-forwarder templates (SX1301_conf,
+// SX1301_conf_1, SX1301_conf_2, ...).
+func ConfKey(i int) string {
+	if i == 0 {
+		return "SX1301_conf"
+	}
+	return fmt.Sprintf("SX1301_conf_%d", i)
+}
+
+// channelByMinRadioCenterFrequency implements sort.Interface for
+// []gw.Channel. The sorting is based on the center frequency of the radio
+// when placing the channel exactly on the left side of the available radio
+// bandwidth.
+type channelByMinRadioCenterFrequency []gw.Channel
+
+func (c channelByMinRadioCenterFrequency) Len() int      { return len(c) }
+func (c channelByMinRadioCenterFrequency) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c channelByMinRadioCenterFrequency) Less(i, j int) bool {
+	return c.minRadioCenterFreq(i) < c.minRadioCenterFreq(j)
+}
+func (c channelByMinRadioCenterFrequency) minRadioCenterFreq(i int) int {
+	channelBandwidth := int(c[i].Bandwidth * 1000)
+	radioBandwidth, ok := radioBandwidthPerChannelBandwidth[channelBandwidth]
+	if !ok {
+		radioBandwidth = defaultRadioBandwidth
+	}
+	return int(c[i].Frequency) - (channelBandwidth / 2) + (radioBandwidth / 2)
+}
+
+// GetConfig transforms the given GatewayConfigPacket into a Config. It
+// determines the radios and their center frequencies and the channels
+// assigned to each radio, packing channels into as few concentrators as
+// possible: when a channel does not fit within the current concentrator's
+// radio bandwidth or multi-SF / LoRa-std / FSK channel budget, an
+// additional concentrator is added rather than returning an error.
+//
+// hwProfile supplies the board-specific values (RSSI offset, TX ranges,
+// clock source, antenna gain, TX LUT calibration, ...) that the
+// channel-plan itself does not carry.
+//
+// The returned Config is validated before being returned; any placement
+// that would violate a concentrator's hardware limits is reported as a
+// *ChannelError. Channels are validated in their original order, before
+// sorting, so a per-channel error identifies the offending channel.
+func GetConfig(conf gw.GatewayConfigPacket, hwProfile HardwareProfile) (Config, error) {
+	var c Config
+
+	for i, ch := range conf.Channels {
+		if err := validateChannel(ch); err != nil {
+			return c, &ChannelError{Channel: i, Reason: err.Error()}
+		}
+	}
+
+	channels := make([]gw.Channel, len(conf.Channels))
+	copy(channels, conf.Channels)
+	sort.Sort(channelByMinRadioCenterFrequency(channels))
+
+	for i, ch := range channels {
+		channelBandwidth := ch.Bandwidth * 1000
+		channelMin := ch.Frequency - (channelBandwidth / 2)
+		channelMax := ch.Frequency + (channelBandwidth / 2)
+		radioBandwidth, ok := radioBandwidthPerChannelBandwidth[channelBandwidth]
+		if !ok {
+			radioBandwidth = defaultRadioBandwidth
+		}
+
+		concentrator, radio, newRadio := findConcentratorSlot(c, ch, channelMin, channelMax, radioBandwidth)
+		if concentrator == -1 {
+			chp := hwProfile.concentratorProfile(len(c.Concentrators))
+			c.Concentrators = append(c.Concentrators, ConcentratorConfig{
+				ClockSource:   chp.ClockSource,
+				AntennaGain:   chp.AntennaGain,
+				LoRaWANPublic: chp.LoRaWANPublic,
+			})
+			concentrator = len(c.Concentrators) - 1
+			newRadio = true
+		}
+
+		cc := &c.Concentrators[concentrator]
+
+		if newRadio {
+			rp := hwProfile.radioProfile(concentrator, len(cc.Radios))
+			cc.Radios = append(cc.Radios, RadioConfig{
+				Enable:       true,
+				Freq:         ch.Frequency - (channelBandwidth / 2) + (radioBandwidth / 2),
+				RSSIOffset:   rp.RSSIOffset,
+				TXEnable:     rp.TXEnable,
+				TXFreqMin:    rp.TXFreqMin,
+				TXFreqMax:    rp.TXFreqMax,
+				TXNotchFreq:  rp.TXNotchFreq,
+				TXLUTConfigs: rp.TXLUTConfigs,
+			})
+			radio = len(cc.Radios) - 1
+		}
+
+		switch {
+		case ch.Modulation == band.FSKModulation:
+			cc.FSKChannelConfig = FSKChannelConfig{
+				Enable:    true,
+				Radio:     radio,
+				IF:        ch.Frequency - cc.Radios[radio].Freq,
+				Bandwidth: ch.Bandwidth,
+				DataRate:  ch.Bitrate,
+				Freq:      ch.Frequency,
+			}
+
+		case ch.Modulation == band.LoRaModulation && len(ch.SpreadingFactors) == 1:
+			cc.LoRaSTDChannelConfig = LoRaSTDChannelConfig{
+				Enable:       true,
+				Radio:        radio,
+				IF:           ch.Frequency - cc.Radios[radio].Freq,
+				Bandwidth:    channelBandwidth,
+				SpreadFactor: ch.SpreadingFactors[0],
+				Freq:         ch.Frequency,
+			}
+
+		case ch.Modulation == band.LoRaModulation:
+			cc.MultiSFChannels = append(cc.MultiSFChannels, MultiSFChannelConfig{
+				Enable: true,
+				Radio:  radio,
+				IF:     ch.Frequency - cc.Radios[radio].Freq,
+				Freq:   ch.Frequency,
+			})
+
+		default:
+			return c, &ChannelError{Channel: i, Reason: fmt.Sprintf("invalid modulation: %s", ch.Modulation)}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// validateChannel rejects channels whose parameters fall outside what the
+// SX1301 chip supports, independent of where they end up being placed.
+func validateChannel(ch gw.Channel) error {
+	if ch.Modulation != band.FSKModulation && ch.Modulation != band.LoRaModulation {
+		return fmt.Errorf("invalid modulation: %s", ch.Modulation)
+	}
+	if ch.Modulation == band.FSKModulation {
+		if ch.Bitrate < minFSKDataRate || ch.Bitrate > maxFSKDataRate {
+			return fmt.Errorf("fsk datarate %d out of range [%d, %d]", ch.Bitrate, minFSKDataRate, maxFSKDataRate)
+		}
+	}
+	return nil
+}
+
+// findConcentratorSlot looks for an existing concentrator that has both
+// budget for the given channel's type (multi-SF / LoRa-std / FSK) and
+// either a radio already covering the channel's frequency window, or room
+// to add one. It returns concentrator == -1 when none of the existing
+// concentrators can take the channel, in which case the caller must add a
+// new concentrator.
+func findConcentratorSlot(c Config, ch gw.Channel, channelMin, channelMax, radioBandwidth int) (concentrator, radio int, newRadio bool) {
+	for ci, cc := range c.Concentrators {
+		if !concentratorHasChannelBudget(cc, ch) {
+			continue
+		}
+
+		for ri, r := range cc.Radios {
+			if channelMin >= r.Freq-(radioBandwidth/2) && channelMax <= r.Freq+(radioBandwidth/2) {
+				return ci, ri, false
+			}
+		}
+
+		if len(cc.Radios) < maxRadiosPerConcentrator {
+			return ci, -1, true
+		}
+	}
+
+	return -1, -1, true
+}
+
+// concentratorHasChannelBudget returns true when the given concentrator
+// still has room for the channel's type.
+func concentratorHasChannelBudget(cc ConcentratorConfig, ch gw.Channel) bool {
+	switch {
+	case ch.Modulation == band.FSKModulation:
+		return !cc.FSKChannelConfig.Enable
+	case ch.Modulation == band.LoRaModulation && len(ch.SpreadingFactors) == 1:
+		return !cc.LoRaSTDChannelConfig.Enable
+	default:
+		return len(cc.MultiSFChannels) < maxMultiSFChannelsPerConcentrator
+	}
+}
+
+// Validate checks that every concentrator in the Config stays within the
+// SX1301 chip's hardware limits: no more than maxRadiosPerConcentrator
+// radios, no more than maxMultiSFChannelsPerConcentrator multi-SF channels,
+// and at most one LoRa-std and one FSK channel. It is mainly useful for
+// property-based testing of the channel-plan packer, since GetConfig always
+// enforces these limits itself.
+func (c Config) Validate() error {
+	for i, cc := range c.Concentrators {
+		if len(cc.Radios) > maxRadiosPerConcentrator {
+			return &ChannelError{Channel: -1, Reason: fmt.Sprintf("concentrator %d has %d radios, max is %d", i, len(cc.Radios), maxRadiosPerConcentrator)}
+		}
+		if len(cc.MultiSFChannels) > maxMultiSFChannelsPerConcentrator {
+			return &ChannelError{Channel: -1, Reason: fmt.Sprintf("concentrator %d has %d multi-SF channels, max is %d", i, len(cc.MultiSFChannels), maxMultiSFChannelsPerConcentrator)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package sx1301
+
+import (
+	"testing"
+
+	"github.com/brocaar/loraserver/api/gw"
+	"github.com/brocaar/lorawan/band"
+)
+
+func multiSFChannel(freq int) gw.Channel {
+	return gw.Channel{
+		Frequency:        freq,
+		Bandwidth:        125,
+		Modulation:       band.LoRaModulation,
+		SpreadingFactors: []int{7, 8, 9, 10, 11, 12},
+	}
+}
+
+// TestGetConfig_MultiConcentratorOverflow verifies that once a concentrator's
+// 8 multi-SF channel budget is exhausted, GetConfig spills the remaining
+// channels onto a new concentrator instead of erroring.
+func TestGetConfig_MultiConcentratorOverflow(t *testing.T) {
+	conf := gw.GatewayConfigPacket{}
+	for i := 0; i < 9; i++ {
+		// Same frequency for every channel so the radio-bandwidth budget is
+		// never the constraint that forces a new concentrator; only the
+		// per-concentrator multi-SF channel budget is.
+		conf.Channels = append(conf.Channels, multiSFChannel(868100000))
+	}
+
+	c, err := GetConfig(conf, HardwareProfile{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(c.Concentrators) != 2 {
+		t.Fatalf("expected 2 concentrators, got %d", len(c.Concentrators))
+	}
+	if len(c.Concentrators[0].MultiSFChannels) != 8 {
+		t.Fatalf("expected 8 multi-SF channels on concentrator 0, got %d", len(c.Concentrators[0].MultiSFChannels))
+	}
+	if len(c.Concentrators[1].MultiSFChannels) != 1 {
+		t.Fatalf("expected 1 multi-SF channel on concentrator 1, got %d", len(c.Concentrators[1].MultiSFChannels))
+	}
+}
+
+// TestGetConfig_FSKDataRateOutOfRange verifies that a FSK channel whose
+// bitrate falls outside the SX1301's supported range is rejected with a
+// *ChannelError identifying the offending channel, rather than silently
+// accepted or placed.
+func TestGetConfig_FSKDataRateOutOfRange(t *testing.T) {
+	conf := gw.GatewayConfigPacket{
+		Channels: []gw.Channel{
+			{
+				Frequency:  868800000,
+				Bandwidth:  125,
+				Modulation: band.FSKModulation,
+				Bitrate:    minFSKDataRate - 1,
+			},
+		},
+	}
+
+	_, err := GetConfig(conf, HardwareProfile{})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	chErr, ok := err.(*ChannelError)
+	if !ok {
+		t.Fatalf("expected *ChannelError, got %T", err)
+	}
+	if chErr.Channel != 0 {
+		t.Fatalf("expected channel 0, got %d", chErr.Channel)
+	}
+}